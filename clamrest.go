@@ -1,20 +1,85 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/dutchcoders/go-clamd"
+	"github.com/klippa-app/clamav-rest/config"
+	"github.com/klippa-app/clamav-rest/metrics"
+	"github.com/klippa-app/clamav-rest/proxy"
+	"github.com/klippa-app/clamav-rest/scanner"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var opts map[string]string
+var cfg *config.Config
+
+// scanPolicy is the composed chain of scanner backends used by scanHandler.
+var scanPolicy *scanner.Policy
+
+// buildScanPolicy composes the configured scanner backends into a Policy:
+// clamd always runs first, YARA and VirusTotal run only on content clamd
+// reported clean, per cfg.YaraRulesPath and cfg.VirusTotalAPIKey.
+func buildScanPolicy(cfg *config.Config) (*scanner.Policy, error) {
+	stages := []scanner.Stage{
+		{Scanner: scanner.NewClamdScanner(cfg.ClamdAddr)},
+	}
+
+	yaraStage, err := newYaraStage(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not set up yara: %w", err)
+	}
+	if yaraStage != nil {
+		yaraStage.OnlyClean = true
+		stages = append(stages, *yaraStage)
+	}
+
+	if cfg.VirusTotalAPIKey != "" {
+		stages = append(stages, scanner.Stage{
+			Scanner:   scanner.NewVirusTotalScanner(cfg.VirusTotalAPIKey, cfg.VirusTotalRequestsPerMinute),
+			OnlyClean: true,
+		})
+	}
+
+	return scanner.NewPolicy(stages...), nil
+}
+
+// statusPending is a clamd-style status string for a scanner.VerdictPending
+// result, which clamd itself never produces.
+const statusPending = "PENDING"
+
+// aggregateVerdict reduces a chain of scanner Results into a single
+// clamd-style status and description, preferring a FOUND verdict from any
+// backend over an ERROR, ERROR over PENDING, and PENDING over OK.
+func aggregateVerdict(results []scanner.Result) (status, description string) {
+	verdict, description := scanner.Aggregate(results)
+	switch verdict {
+	case scanner.VerdictFound:
+		return clamd.RES_FOUND, description
+	case scanner.VerdictError:
+		return clamd.RES_ERROR, description
+	case scanner.VerdictPending:
+		return statusPending, description
+	default:
+		return clamd.RES_OK, description
+	}
+}
 
 func init() {
 	log.SetOutput(ioutil.Discard)
@@ -35,7 +100,7 @@ func writeError(w http.ResponseWriter, statusCode int, err string) {
 }
 
 func home(w http.ResponseWriter, r *http.Request) {
-	c := clamd.NewClamd(opts["CLAMD_PORT"])
+	c := clamd.NewClamd(cfg.ClamdAddr)
 
 	response, err := c.Stats()
 
@@ -53,6 +118,45 @@ func home(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, string(resJson))
 }
 
+// verdictLabel maps a clamd scan status to the metrics.Verdict* label used
+// for ScansTotal.
+func verdictLabel(status string) string {
+	switch status {
+	case clamd.RES_OK:
+		return metrics.VerdictOK
+	case clamd.RES_FOUND:
+		return metrics.VerdictFound
+	case clamd.RES_PARSE_ERROR:
+		return metrics.VerdictParseError
+	case statusPending:
+		return metrics.VerdictPending
+	default:
+		return metrics.VerdictError
+	}
+}
+
+// healthzHandler reports the process as alive, regardless of clamd's state.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "ok")
+}
+
+// readyzHandler reports whether clamd is reachable, for use as a Kubernetes
+// readiness probe.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := scanPolicy.Ping(r.Context()); err != nil {
+		metrics.ClamdHealthy.Set(0)
+		writeError(w, http.StatusServiceUnavailable, "clamd unreachable: "+err.Error())
+		return
+	}
+
+	metrics.ClamdHealthy.Set(1)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "ok")
+}
+
+// scanPathHandler scans a file already present on the REST host's
+// filesystem through scanPolicy, the same chain used by scanHandler.
 func scanPathHandler(w http.ResponseWriter, r *http.Request) {
 	paths, ok := r.URL.Query()["path"]
 	if !ok || len(paths[0]) < 1 {
@@ -62,20 +166,34 @@ func scanPathHandler(w http.ResponseWriter, r *http.Request) {
 
 	path := paths[0]
 
-	c := clamd.NewClamd(opts["CLAMD_PORT"])
-	response, err := c.AllMatchScanFile(path)
+	file, err := os.Open(path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not open file: "+err.Error())
+		return
+	}
+	defer file.Close()
 
+	info, err := file.Stat()
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "Could not scan file: "+err.Error())
+		writeError(w, http.StatusInternalServerError, "Could not stat file: "+err.Error())
 		return
 	}
 
-	var scanResults []*clamd.ScanResult
+	meta := scanner.Meta{Filename: filepath.Base(path), Size: info.Size()}
 
-	for responseItem := range response {
-		scanResults = append(scanResults, responseItem)
+	metrics.ScansInFlight.Inc()
+	defer metrics.ScansInFlight.Dec()
+	started := time.Now()
+	scanResults, err := scanPolicy.Scan(r.Context(), file, meta)
+	if err != nil {
+		metrics.ClamdConnectionFailures.Inc()
+		writeError(w, http.StatusInternalServerError, "Could not scan file: "+err.Error())
+		return
 	}
 
+	status, _ := aggregateVerdict(scanResults)
+	metrics.ObserveScan(verdictLabel(status), time.Since(started).Seconds(), int(info.Size()))
+
 	resJson, eRes := json.Marshal(scanResults)
 	if eRes != nil {
 		fmt.Println(eRes)
@@ -85,12 +203,52 @@ func scanPathHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, string(resJson))
 }
 
+// scanResult is the per-part verdict returned by scanHandler.
+type scanResult struct {
+	Status      string           `json:"status"`
+	Description string           `json:"description,omitempty"`
+	Hash        string           `json:"hash,omitempty"`
+	Size        int              `json:"size,omitempty"`
+	Scanners    []scanner.Result `json:"scanners,omitempty"`
+}
+
+// scanResponse aggregates every part of a multipart upload into a single
+// verdict, alongside the individual file results and any non-file form
+// fields for auditability.
+type scanResponse struct {
+	Verdict string                 `json:"verdict"`
+	Files   map[string]*scanResult `json:"files,omitempty"`
+	Fields  map[string]string      `json:"fields,omitempty"`
+}
+
+type uploadedFile struct {
+	key     string // form field name + "/" + filename, unique per part
+	name    string
+	content *bytes.Buffer
+}
+
+// isRequestTooLarge reports whether err was caused by http.MaxBytesReader
+// rejecting a body that exceeded cfg.MaxRequestSize.
+func isRequestTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "too large")
+}
+
 //This is where the action happens.
 func scanHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
-	//POST takes the uploaded file(s) and saves it to disk.
+	//POST takes the uploaded file(s) and scans them.
 	case "POST":
-		c := clamd.NewClamd(opts["CLAMD_PORT"])
+		// Content-Length fast path: reject oversize requests before reading
+		// any of the body, so a client sending Expect: 100-continue never
+		// gets the go-ahead to upload it.
+		if cfg.MaxRequestSize > 0 && r.ContentLength > cfg.MaxRequestSize {
+			writeError(w, http.StatusRequestEntityTooLarge, "Request exceeds maximum allowed size")
+			return
+		}
+		if cfg.MaxRequestSize > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxRequestSize)
+		}
+
 		//get the multipart reader for the request.
 		reader, err := r.MultipartReader()
 
@@ -99,59 +257,199 @@ func scanHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		part, err := reader.NextPart()
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, "Could not read file: "+err.Error())
-			return
+		var files []uploadedFile
+		fields := make(map[string]string)
+
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				if isRequestTooLarge(err) {
+					writeError(w, http.StatusRequestEntityTooLarge, "Request exceeds maximum allowed size")
+					return
+				}
+				writeError(w, http.StatusInternalServerError, "Could not read part: "+err.Error())
+				return
+			}
+
+			//if part.FileName() is empty, this is a regular form field.
+			if part.FileName() == "" {
+				value, err := ioutil.ReadAll(part)
+				if err != nil {
+					writeError(w, http.StatusInternalServerError, fmt.Sprintf("Could not read field %q: %v", part.FormName(), err))
+					return
+				}
+				fields[part.FormName()] = string(value)
+				continue
+			}
+
+			var content bytes.Buffer
+			if _, err := io.Copy(&content, part); err != nil {
+				if isRequestTooLarge(err) {
+					writeError(w, http.StatusRequestEntityTooLarge, "Request exceeds maximum allowed size")
+					return
+				}
+				writeError(w, http.StatusInternalServerError, fmt.Sprintf("Could not read file %q: %v", part.FileName(), err))
+				return
+			}
+			files = append(files, uploadedFile{
+				key:     part.FormName() + "/" + part.FileName(),
+				name:    part.FileName(),
+				content: &content,
+			})
 		}
 
-		//if part.FileName() is empty, skip this iteration.
-		if part.FileName() == "" {
-			writeError(w, http.StatusBadRequest, "Filename is empty")
+		if len(files) == 0 {
+			writeError(w, http.StatusBadRequest, "No file parts found")
 			return
 		}
 
-		fmt.Printf(time.Now().Format(time.RFC3339) + " Started scanning: " + part.FileName() + "\n")
-		var abort chan bool
-		response, err := c.ScanStream(part, abort)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, "Could not scan file: "+err.Error())
-			return
+		// Parts can legitimately share a form field name and filename (e.g.
+		// bulk upload widgets); disambiguate so every part still gets its
+		// own entry in results instead of clobbering one another.
+		keyCounts := make(map[string]int, len(files))
+		for i, f := range files {
+			keyCounts[f.key]++
+			if n := keyCounts[f.key]; n > 1 {
+				files[i].key = fmt.Sprintf("%s#%d", f.key, n)
+			}
 		}
 
-		s := <-response
+		ctx := r.Context()
+		if cfg.ScanTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, cfg.ScanTimeout)
+			defer cancel()
+		}
 
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		results := make(map[string]*scanResult, len(files))
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+
+		for _, f := range files {
+			wg.Add(1)
+			go func(f uploadedFile) {
+				defer wg.Done()
+
+				fmt.Printf(time.Now().Format(time.RFC3339) + " Started scanning: " + f.name + "\n")
+
+				metrics.ScansInFlight.Inc()
+				defer metrics.ScansInFlight.Dec()
+				started := time.Now()
+
+				heartbeat := time.NewTicker(5 * time.Second)
+				stop := make(chan struct{})
+				go func() {
+					for {
+						select {
+						case <-heartbeat.C:
+							fmt.Printf(time.Now().Format(time.RFC3339)+" Still scanning: %v (%v elapsed)\n", f.name, time.Since(started).Round(time.Second))
+						case <-stop:
+							return
+						}
+					}
+				}()
+				defer func() {
+					heartbeat.Stop()
+					close(stop)
+				}()
+
+				sum := sha256.Sum256(f.content.Bytes())
+				hash := hex.EncodeToString(sum[:])
+				meta := scanner.Meta{Filename: f.name, Hash: hash, Size: int64(f.content.Len())}
+
+				scanResults, err := scanPolicy.Scan(ctx, bytes.NewReader(f.content.Bytes()), meta)
+				if err != nil {
+					metrics.ClamdConnectionFailures.Inc()
+					metrics.ObserveScan(metrics.VerdictError, time.Since(started).Seconds(), 0)
+					mu.Lock()
+					results[f.key] = &scanResult{Status: clamd.RES_ERROR, Description: err.Error(), Hash: hash}
+					mu.Unlock()
+					return
+				}
+
+				status, description := aggregateVerdict(scanResults)
+				metrics.ObserveScan(verdictLabel(status), time.Since(started).Seconds(), f.content.Len())
+
+				mu.Lock()
+				results[f.key] = &scanResult{
+					Status:      status,
+					Description: description,
+					Hash:        hash,
+					Size:        f.content.Len(),
+					Scanners:    scanResults,
+				}
+				mu.Unlock()
+
+				fmt.Printf(time.Now().Format(time.RFC3339)+" Finished scanning: %v, %v\n", f.name, status)
+			}(f)
+		}
+
+		wg.Wait()
+
+		verdict := clamd.RES_OK
+		statusCode := http.StatusOK
+		for _, res := range results {
+			switch res.Status {
+			case clamd.RES_FOUND:
+				verdict = clamd.RES_FOUND
+				statusCode = http.StatusNotAcceptable
+			case clamd.RES_ERROR:
+				if verdict != clamd.RES_FOUND {
+					verdict = clamd.RES_ERROR
+					statusCode = http.StatusBadGateway
+				}
+			case statusPending:
+				if verdict != clamd.RES_FOUND && verdict != clamd.RES_ERROR {
+					verdict = statusPending
+					statusCode = http.StatusAccepted
+				}
+			}
+		}
 
-		respJson, err := json.Marshal(&s)
+		respJson, err := json.Marshal(&scanResponse{Verdict: verdict, Files: results, Fields: fields})
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, "Could not marshal JSON: "+err.Error())
 			return
 		}
 
-		switch s.Status {
-		case clamd.RES_OK:
-			w.WriteHeader(http.StatusOK)
-		case clamd.RES_FOUND:
-			w.WriteHeader(http.StatusNotAcceptable)
-		case clamd.RES_ERROR:
-			w.WriteHeader(http.StatusBadRequest)
-		case clamd.RES_PARSE_ERROR:
-			w.WriteHeader(http.StatusPreconditionFailed)
-		default:
-			w.WriteHeader(http.StatusNotImplemented)
-		}
-
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(statusCode)
 		fmt.Fprint(w, string(respJson))
-		fmt.Printf(time.Now().Format(time.RFC3339)+" Scan result for: %v, %v\n", part.FileName(), s)
-		fmt.Printf(time.Now().Format(time.RFC3339) + " Finished scanning: " + part.FileName() + "\n")
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
-func waitForClamD(port string, times int) {
-	clamdTest := clamd.NewClamd(port)
+// setupProxy wires up the scanning reverse proxy when ProxyUpstreamURL is
+// configured, mounting it at /proxy/.
+func setupProxy() {
+	if cfg.ProxyUpstreamURL == "" {
+		return
+	}
+
+	upstreamURL, err := url.Parse(cfg.ProxyUpstreamURL)
+	if err != nil {
+		fmt.Printf("Invalid proxy upstream URL %q: %v\n", cfg.ProxyUpstreamURL, err)
+		os.Exit(1)
+	}
+
+	proxyCfg := proxy.Config{
+		Upstream:            upstreamURL,
+		ScannedContentTypes: cfg.ProxyScannedContentTypes,
+		Bypass:              cfg.ProxyBypass,
+		MaxRequestSize:      cfg.ProxyMaxRequestSize,
+		ScanTimeout:         cfg.ScanTimeout,
+	}
+
+	fmt.Printf("Proxying uploads to %v\n", upstreamURL)
+	http.Handle("/proxy/", http.StripPrefix("/proxy", proxy.New(proxyCfg, scanPolicy)))
+}
+
+func waitForClamD(addr string, times int) {
+	clamdTest := clamd.NewClamd(addr)
 	clamdTest.Ping()
 	version, err := clamdTest.Version()
 
@@ -159,7 +457,7 @@ func waitForClamD(port string, times int) {
 		if times < 30 {
 			fmt.Printf("clamD not running, waiting times [%v]\n", times)
 			time.Sleep(time.Second * 4)
-			waitForClamD(port, times+1)
+			waitForClamD(addr, times+1)
 		} else {
 			fmt.Printf("Error getting clamd version: %v\n", err)
 			os.Exit(1)
@@ -171,40 +469,92 @@ func waitForClamD(port string, times int) {
 	}
 }
 
-func main() {
-
-	const (
-		PORT     = ":9000"
-		SSL_PORT = ":9443"
-	)
+// logRequests wraps h to print a line per request, when enabled via
+// -log-requests, LOG_REQUESTS or log_requests.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.LogRequests {
+			fmt.Printf("%s %s %s\n", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
 
-	opts = make(map[string]string)
+// serve starts an HTTP(S) server on addr (supporting "unix:/path" sockets)
+// in the background and returns it at once; wg is marked done once the
+// server has stopped.
+func serve(wg *sync.WaitGroup, addr, certFile, keyFile string) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: logRequests(http.DefaultServeMux)}
 
-	for _, e := range os.Environ() {
-		pair := strings.Split(e, "=")
-		opts[pair[0]] = pair[1]
+	listener, err := config.Listen(addr, cfg.SocketPerms)
+	if err != nil {
+		fmt.Printf("Could not listen on %v: %v\n", addr, err)
+		os.Exit(1)
 	}
 
-	if opts["CLAMD_PORT"] == "" {
-		opts["CLAMD_PORT"] = "tcp://localhost:3310"
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		var serveErr error
+		if certFile != "" && keyFile != "" {
+			serveErr = srv.ServeTLS(listener, certFile, keyFile)
+		} else {
+			serveErr = srv.Serve(listener)
+		}
+		if serveErr != nil && serveErr != http.ErrServerClosed {
+			fmt.Printf("Server on %v stopped: %v\n", addr, serveErr)
+		}
+	}()
+
+	return srv
+}
+
+func main() {
+	loaded, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Printf("Invalid configuration: %v\n", err)
+		os.Exit(1)
 	}
+	cfg = loaded
 
 	fmt.Printf("Starting clamav rest bridge\n")
-	fmt.Printf("Connecting to clamd on %v\n", opts["CLAMD_PORT"])
-	waitForClamD(opts["CLAMD_PORT"], 1)
+	fmt.Printf("Connecting to clamd on %v\n", cfg.ClamdAddr)
+	waitForClamD(cfg.ClamdAddr, 1)
 
-	fmt.Printf("Connected to clamd on %v\n", opts["CLAMD_PORT"])
+	fmt.Printf("Connected to clamd on %v\n", cfg.ClamdAddr)
+
+	policy, err := buildScanPolicy(cfg)
+	if err != nil {
+		fmt.Printf("Invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+	scanPolicy = policy
 
 	http.HandleFunc("/scan", scanHandler)
 	http.HandleFunc("/scanPath", scanPathHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
 	http.HandleFunc("/", home)
 
 	// Prometheus metrics
-	http.Handle("/metrics", promhttp.Handler())
+	http.Handle(cfg.MetricsPath, promhttp.Handler())
+
+	setupProxy()
+
+	var wg sync.WaitGroup
+	httpSrv := serve(&wg, cfg.ListenAddr, "", "")
+	httpsSrv := serve(&wg, cfg.ListenAddrTLS, cfg.TLSCertFile, cfg.TLSKeyFile)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
 
-	// Start the HTTPS server in a goroutine
-	go http.ListenAndServeTLS(SSL_PORT, "/etc/ssl/clamav-rest/server.crt", "/etc/ssl/clamav-rest/server.key", nil)
+	fmt.Printf("Shutting down\n")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	httpSrv.Shutdown(ctx)
+	httpsSrv.Shutdown(ctx)
 
-	// Start the HTTP server
-	http.ListenAndServe(PORT, nil)
+	wg.Wait()
 }
@@ -0,0 +1,228 @@
+// Package config loads clamav-rest's runtime configuration from an optional
+// YAML file, the process environment and CLI flags, applied in that order
+// of increasing precedence.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds every tunable of the clamav-rest server.
+type Config struct {
+	ListenAddr    string      `yaml:"listen_addr"`
+	ListenAddrTLS string      `yaml:"listen_addr_tls"`
+	TLSCertFile   string      `yaml:"tls_cert_file"`
+	TLSKeyFile    string      `yaml:"tls_key_file"`
+	SocketPerms   os.FileMode `yaml:"socket_perms"`
+
+	ClamdAddr      string        `yaml:"clamd_addr"`
+	MaxRequestSize int64         `yaml:"max_request_size"`
+	ScanTimeout    time.Duration `yaml:"scan_timeout"`
+
+	LogRequests bool   `yaml:"log_requests"`
+	MetricsPath string `yaml:"metrics_path"`
+
+	ProxyUpstreamURL         string   `yaml:"proxy_upstream_url"`
+	ProxyScannedContentTypes []string `yaml:"proxy_scanned_content_types"`
+	ProxyBypass              []string `yaml:"proxy_bypass"`
+	ProxyMaxRequestSize      int64    `yaml:"proxy_max_request_size"`
+
+	// VirusTotalAPIKey enables the VirusTotal secondary scanner backend when
+	// set. It only runs on content clamd already reported clean.
+	VirusTotalAPIKey            string `yaml:"virustotal_api_key"`
+	VirusTotalRequestsPerMinute int    `yaml:"virustotal_requests_per_minute"`
+
+	// YaraRulesPath enables the YARA secondary scanner backend when set. It
+	// only runs on content clamd already reported clean, and only takes
+	// effect in binaries built with -tags yara.
+	YaraRulesPath string `yaml:"yara_rules_path"`
+}
+
+// Default returns a Config populated with clamav-rest's historical defaults.
+func Default() *Config {
+	return &Config{
+		ListenAddr:    ":9000",
+		ListenAddrTLS: ":9443",
+		TLSCertFile:   "/etc/ssl/clamav-rest/server.crt",
+		TLSKeyFile:    "/etc/ssl/clamav-rest/server.key",
+		SocketPerms:   0660,
+		ClamdAddr:     "tcp://localhost:3310",
+		ScanTimeout:   60 * time.Second,
+		MetricsPath:   "/metrics",
+	}
+}
+
+// Load builds a Config from, in increasing precedence: built-in defaults, an
+// optional YAML file (-config / CONFIG_FILE), the process environment, and
+// CLI flags.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("clamav-rest", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file")
+	listenAddr := fs.String("listen", "", "address to listen on, e.g. :9000 or unix:/run/clamav-rest.sock")
+	listenAddrTLS := fs.String("listen-tls", "", "address to listen on for TLS")
+	tlsCertFile := fs.String("tls-cert", "", "path to the TLS certificate")
+	tlsKeyFile := fs.String("tls-key", "", "path to the TLS key")
+	clamdAddr := fs.String("clamd-addr", "", "clamd address, e.g. tcp://localhost:3310")
+	maxRequestSize := fs.Int64("max-request-size", -1, "maximum accepted request body size in bytes, 0 for unlimited")
+	scanTimeout := fs.Duration("scan-timeout", 0, "timeout for a single scan")
+	logRequests := fs.Bool("log-requests", false, "log every request")
+	metricsPath := fs.String("metrics-path", "", "path the Prometheus metrics are served on")
+	yaraRulesPath := fs.String("yara-rules-path", "", "path to a YARA rules file, enabling the YARA secondary scanner (requires a binary built with -tags yara)")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.mergeFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg.mergeEnv()
+
+	if *listenAddr != "" {
+		cfg.ListenAddr = *listenAddr
+	}
+	if *listenAddrTLS != "" {
+		cfg.ListenAddrTLS = *listenAddrTLS
+	}
+	if *tlsCertFile != "" {
+		cfg.TLSCertFile = *tlsCertFile
+	}
+	if *tlsKeyFile != "" {
+		cfg.TLSKeyFile = *tlsKeyFile
+	}
+	if *clamdAddr != "" {
+		cfg.ClamdAddr = *clamdAddr
+	}
+	if *maxRequestSize >= 0 {
+		cfg.MaxRequestSize = *maxRequestSize
+	}
+	if *scanTimeout > 0 {
+		cfg.ScanTimeout = *scanTimeout
+	}
+	if *logRequests {
+		cfg.LogRequests = true
+	}
+	if *metricsPath != "" {
+		cfg.MetricsPath = *metricsPath
+	}
+	if *yaraRulesPath != "" {
+		cfg.YaraRulesPath = *yaraRulesPath
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) mergeFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file %q: %w", path, err)
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("could not parse config file %q: %w", path, err)
+	}
+	return nil
+}
+
+func (cfg *Config) mergeEnv() {
+	if v := os.Getenv("LISTEN_ADDR"); v != "" {
+		cfg.ListenAddr = v
+	}
+	if v := os.Getenv("LISTEN_ADDR_TLS"); v != "" {
+		cfg.ListenAddrTLS = v
+	}
+	if v := os.Getenv("TLS_CERT_FILE"); v != "" {
+		cfg.TLSCertFile = v
+	}
+	if v := os.Getenv("TLS_KEY_FILE"); v != "" {
+		cfg.TLSKeyFile = v
+	}
+	if v := os.Getenv("SOCKET_PERMS"); v != "" {
+		if perms, err := strconv.ParseUint(v, 8, 32); err == nil {
+			cfg.SocketPerms = os.FileMode(perms)
+		}
+	}
+	// CLAMD_PORT is kept for backwards compatibility with earlier releases.
+	if v := os.Getenv("CLAMD_PORT"); v != "" {
+		cfg.ClamdAddr = v
+	}
+	if v := os.Getenv("CLAMD_ADDR"); v != "" {
+		cfg.ClamdAddr = v
+	}
+	if v := os.Getenv("MAX_REQUEST_SIZE"); v != "" {
+		if size, err := strconv.ParseInt(v, 10, 64); err == nil {
+			cfg.MaxRequestSize = size
+		}
+	}
+	if v := os.Getenv("SCAN_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			cfg.ScanTimeout = d
+		}
+	}
+	if v := os.Getenv("LOG_REQUESTS"); v != "" {
+		cfg.LogRequests = v == "1" || strings.EqualFold(v, "true")
+	}
+	if v := os.Getenv("METRICS_PATH"); v != "" {
+		cfg.MetricsPath = v
+	}
+	if v := os.Getenv("PROXY_UPSTREAM_URL"); v != "" {
+		cfg.ProxyUpstreamURL = v
+	}
+	if v := os.Getenv("PROXY_SCANNED_CONTENT_TYPES"); v != "" {
+		cfg.ProxyScannedContentTypes = strings.Split(v, ",")
+	}
+	if v := os.Getenv("PROXY_BYPASS"); v != "" {
+		cfg.ProxyBypass = strings.Split(v, ",")
+	}
+	if v := os.Getenv("PROXY_MAX_REQUEST_SIZE"); v != "" {
+		if size, err := strconv.ParseInt(v, 10, 64); err == nil {
+			cfg.ProxyMaxRequestSize = size
+		}
+	}
+	if v := os.Getenv("VIRUSTOTAL_API_KEY"); v != "" {
+		cfg.VirusTotalAPIKey = v
+	}
+	if v := os.Getenv("VIRUSTOTAL_REQUESTS_PER_MINUTE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.VirusTotalRequestsPerMinute = n
+		}
+	}
+	if v := os.Getenv("YARA_RULES_PATH"); v != "" {
+		cfg.YaraRulesPath = v
+	}
+}
+
+// Listen opens a net.Listener for addr, which is either a normal host:port
+// (e.g. ":9000") or "unix:/path/to.sock" for a Unix domain socket created
+// with the given permissions.
+func Listen(addr string, perms os.FileMode) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		os.Remove(path)
+
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, perms); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+
+	return net.Listen("tcp", addr)
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("could not write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	def := Default()
+	if cfg.ClamdAddr != def.ClamdAddr {
+		t.Errorf("ClamdAddr = %q, want default %q", cfg.ClamdAddr, def.ClamdAddr)
+	}
+	if cfg.ScanTimeout != def.ScanTimeout {
+		t.Errorf("ScanTimeout = %v, want default %v", cfg.ScanTimeout, def.ScanTimeout)
+	}
+}
+
+func TestLoadFileOverridesDefaults(t *testing.T) {
+	path := writeConfigFile(t, "clamd_addr: tcp://from-file:3310\n")
+
+	cfg, err := Load([]string{"-config", path})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.ClamdAddr != "tcp://from-file:3310" {
+		t.Errorf("ClamdAddr = %q, want %q", cfg.ClamdAddr, "tcp://from-file:3310")
+	}
+}
+
+func TestLoadEnvOverridesFile(t *testing.T) {
+	path := writeConfigFile(t, "clamd_addr: tcp://from-file:3310\n")
+	t.Setenv("CLAMD_ADDR", "tcp://from-env:3310")
+
+	cfg, err := Load([]string{"-config", path})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.ClamdAddr != "tcp://from-env:3310" {
+		t.Errorf("ClamdAddr = %q, want %q", cfg.ClamdAddr, "tcp://from-env:3310")
+	}
+}
+
+func TestLoadFlagOverridesEnv(t *testing.T) {
+	path := writeConfigFile(t, "clamd_addr: tcp://from-file:3310\n")
+	t.Setenv("CLAMD_ADDR", "tcp://from-env:3310")
+
+	cfg, err := Load([]string{"-config", path, "-clamd-addr", "tcp://from-flag:3310"})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.ClamdAddr != "tcp://from-flag:3310" {
+		t.Errorf("ClamdAddr = %q, want %q", cfg.ClamdAddr, "tcp://from-flag:3310")
+	}
+}
+
+func TestLoadScanTimeoutPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "scan_timeout: 5s\n")
+	t.Setenv("SCAN_TIMEOUT", "10s")
+
+	cfg, err := Load([]string{"-config", path})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.ScanTimeout != 10*time.Second {
+		t.Errorf("ScanTimeout = %v, want %v (env should override the file)", cfg.ScanTimeout, 10*time.Second)
+	}
+
+	cfg, err = Load([]string{"-config", path, "-scan-timeout", "15s"})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.ScanTimeout != 15*time.Second {
+		t.Errorf("ScanTimeout = %v, want %v (flag should override the env)", cfg.ScanTimeout, 15*time.Second)
+	}
+}
+
+func TestLoadLogRequestsEnvParsing(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"1", true},
+		{"true", true},
+		{"TRUE", true},
+		{"0", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if tt.value != "" {
+				t.Setenv("LOG_REQUESTS", tt.value)
+			}
+
+			cfg, err := Load(nil)
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if cfg.LogRequests != tt.want {
+				t.Errorf("LOG_REQUESTS=%q: LogRequests = %v, want %v", tt.value, cfg.LogRequests, tt.want)
+			}
+		})
+	}
+}
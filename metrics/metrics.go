@@ -0,0 +1,83 @@
+// Package metrics registers and exposes the Prometheus metrics emitted by
+// clamav-rest's scan operations, so they can be scraped from /metrics and
+// wired into Grafana dashboards or Kubernetes probes.
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const namespace = "clamav_rest"
+
+// Verdict labels used with ScansTotal.
+const (
+	VerdictOK         = "ok"
+	VerdictFound      = "found"
+	VerdictError      = "error"
+	VerdictParseError = "parse_error"
+	VerdictPending    = "pending"
+)
+
+var (
+	// ScansTotal counts completed scans, partitioned by verdict.
+	ScansTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scans_total",
+		Help:      "Total number of files scanned, partitioned by verdict.",
+	}, []string{"verdict"})
+
+	// BytesScanned sums the number of bytes streamed to clamd.
+	BytesScanned = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_scanned_total",
+		Help:      "Total number of bytes streamed to clamd for scanning.",
+	})
+
+	// ScanDuration tracks how long scanning a single file through the whole
+	// scanner chain takes, clamd and any secondary backends included.
+	ScanDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "scan_duration_seconds",
+		Help:      "Time spent scanning a single file through the scanner chain.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// ClamdConnectionFailures counts failed attempts to reach clamd.
+	ClamdConnectionFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "clamd_connection_failures_total",
+		Help:      "Total number of failed connection attempts to clamd.",
+	})
+
+	// ScansInFlight tracks how many files are currently going through the
+	// scanner chain.
+	ScansInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "scans_in_flight",
+		Help:      "Number of files currently being scanned by the scanner chain.",
+	})
+
+	// ClamdHealthy reflects the outcome of the last clamd health check, as
+	// used by the /readyz endpoint.
+	ClamdHealthy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "clamd_healthy",
+		Help:      "1 if the last clamd health check succeeded, 0 otherwise.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		ScansTotal,
+		BytesScanned,
+		ScanDuration,
+		ClamdConnectionFailures,
+		ScansInFlight,
+		ClamdHealthy,
+	)
+}
+
+// ObserveScan records a completed scan's verdict, duration and size.
+func ObserveScan(verdict string, durationSeconds float64, size int) {
+	ScansTotal.WithLabelValues(verdict).Inc()
+	ScanDuration.Observe(durationSeconds)
+	BytesScanned.Add(float64(size))
+}
@@ -0,0 +1,311 @@
+// Package proxy implements a transparent scanning reverse proxy that sits in
+// front of an upstream HTTP application. Incoming multipart/form-data (and
+// raw) request bodies are intercepted, every file part is streamed through
+// the configured scanner.Policy, and the request is only forwarded to the
+// upstream once it is confirmed clean.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"encoding/json"
+
+	"github.com/klippa-app/clamav-rest/metrics"
+	"github.com/klippa-app/clamav-rest/scanner"
+)
+
+// Config controls how the scanning proxy behaves.
+type Config struct {
+	// Upstream is the application requests are forwarded to once they pass
+	// scanning.
+	Upstream *url.URL
+
+	// ScannedContentTypes lists the request Content-Types that are
+	// intercepted and scanned. An empty list means every request is
+	// scanned.
+	ScannedContentTypes []string
+
+	// Bypass lists request path prefixes that are forwarded without
+	// scanning, e.g. health checks on the upstream itself.
+	Bypass []string
+
+	// MaxRequestSize is the maximum number of bytes read from the request
+	// body before it is rejected. Zero means unlimited.
+	MaxRequestSize int64
+
+	// RejectStatusCode is the HTTP status returned to the client when a
+	// part matches a signature. Defaults to http.StatusNotAcceptable.
+	RejectStatusCode int
+
+	// ScanTimeout bounds how long a single scan may take before it is
+	// cancelled. Zero means no timeout.
+	ScanTimeout time.Duration
+}
+
+// Proxy is a reverse proxy that scans uploads before forwarding them to an
+// upstream application.
+type Proxy struct {
+	cfg     Config
+	policy  *scanner.Policy
+	reverse *httputil.ReverseProxy
+}
+
+// New returns a Proxy that scans uploads with policy and forwards clean
+// requests to cfg.Upstream.
+func New(cfg Config, policy *scanner.Policy) *Proxy {
+	if cfg.RejectStatusCode == 0 {
+		cfg.RejectStatusCode = http.StatusNotAcceptable
+	}
+
+	return &Proxy{
+		cfg:     cfg,
+		policy:  policy,
+		reverse: httputil.NewSingleHostReverseProxy(cfg.Upstream),
+	}
+}
+
+type rejection struct {
+	Error string `json:"Error"`
+	File  string `json:"File,omitempty"`
+}
+
+func (p *Proxy) reject(w http.ResponseWriter, statusCode int, file, reason string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	body, _ := json.Marshal(&rejection{Error: reason, File: file})
+	w.Write(body)
+}
+
+// isRequestTooLarge reports whether err was caused by http.MaxBytesReader
+// rejecting a body that exceeded cfg.MaxRequestSize.
+func isRequestTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "too large")
+}
+
+func (p *Proxy) bypassed(r *http.Request) bool {
+	for _, prefix := range p.cfg.Bypass {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) shouldScan(contentType string) bool {
+	if len(p.cfg.ScannedContentTypes) == 0 {
+		return true
+	}
+	for _, scanned := range p.cfg.ScannedContentTypes {
+		if contentType == scanned {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP intercepts uploads, scans them via the configured Policy, and
+// forwards clean requests to the configured upstream. Requests containing an
+// infected, errored, or not-yet-analyzed part are rejected with
+// cfg.RejectStatusCode and never reach the upstream. The scan is bound to
+// r.Context(), so it is cancelled if the client disconnects, and is
+// additionally bounded by cfg.ScanTimeout if set.
+//
+// A missing or malformed Content-Type is not treated as "nothing to scan":
+// it fails closed and is scanned as a raw body, since a client can trivially
+// omit or mangle the header to dodge scanning otherwise.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.bypassed(r) {
+		p.reverse.ServeHTTP(w, r)
+		return
+	}
+
+	if p.cfg.MaxRequestSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, p.cfg.MaxRequestSize)
+	}
+
+	ct, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && !p.shouldScan(ct) {
+		p.reverse.ServeHTTP(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	if p.cfg.ScanTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.cfg.ScanTimeout)
+		defer cancel()
+	}
+
+	if err != nil || !strings.HasPrefix(ct, "multipart/") {
+		if err := p.scanRaw(ctx, r); err != nil {
+			if isRequestTooLarge(err) {
+				p.reject(w, http.StatusRequestEntityTooLarge, "", "request exceeds maximum allowed size")
+				return
+			}
+			p.reject(w, p.cfg.RejectStatusCode, "", err.Error())
+			return
+		}
+		p.reverse.ServeHTTP(w, r)
+		return
+	}
+
+	if err := p.scanMultipart(ctx, r, params["boundary"]); err != nil {
+		if isRequestTooLarge(err) {
+			p.reject(w, http.StatusRequestEntityTooLarge, "", "request exceeds maximum allowed size")
+			return
+		}
+		p.reject(w, p.cfg.RejectStatusCode, "", err.Error())
+		return
+	}
+
+	p.reverse.ServeHTTP(w, r)
+}
+
+// scanMultipart reads every part of the multipart body, scans file parts via
+// scanContent, and rebuilds r.Body from the buffered parts so it can be
+// forwarded to the upstream.
+func (p *Proxy) scanMultipart(ctx context.Context, r *http.Request, boundary string) error {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.SetBoundary(boundary)
+
+	reader := multipart.NewReader(r.Body, boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("could not read part: %w", err)
+		}
+
+		if part.FileName() == "" {
+			value, err := ioutil.ReadAll(part)
+			if err != nil {
+				return fmt.Errorf("could not read field %q: %w", part.FormName(), err)
+			}
+			mw.WriteField(part.FormName(), string(value))
+			continue
+		}
+
+		var content bytes.Buffer
+		if _, err := io.Copy(&content, part); err != nil {
+			return fmt.Errorf("could not read %q: %w", part.FileName(), err)
+		}
+
+		if err := p.scanContent(ctx, part.FileName(), content.Bytes()); err != nil {
+			return err
+		}
+
+		fw, err := mw.CreateFormFile(part.FormName(), part.FileName())
+		if err != nil {
+			return fmt.Errorf("could not reconstruct %q: %w", part.FileName(), err)
+		}
+		if _, err := fw.Write(content.Bytes()); err != nil {
+			return fmt.Errorf("could not reconstruct %q: %w", part.FileName(), err)
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return fmt.Errorf("could not rebuild multipart body: %w", err)
+	}
+
+	r.Body = ioutil.NopCloser(&buf)
+	r.ContentLength = int64(buf.Len())
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return nil
+}
+
+func (p *Proxy) scanRaw(ctx context.Context, r *http.Request) error {
+	var content bytes.Buffer
+	if _, err := io.Copy(&content, r.Body); err != nil {
+		return fmt.Errorf("could not read body: %w", err)
+	}
+
+	if err := p.scanContent(ctx, "", content.Bytes()); err != nil {
+		return err
+	}
+
+	r.Body = ioutil.NopCloser(&content)
+	return nil
+}
+
+// scanContent runs content through the Policy, reporting metrics and a
+// heartbeat for long-running scans in parity with scanHandler, and rejects
+// anything the Policy did not confirm clean.
+func (p *Proxy) scanContent(ctx context.Context, filename string, content []byte) error {
+	metrics.ScansInFlight.Inc()
+	defer metrics.ScansInFlight.Dec()
+	started := time.Now()
+
+	heartbeat := time.NewTicker(5 * time.Second)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-heartbeat.C:
+				fmt.Printf(time.Now().Format(time.RFC3339)+" proxy: still scanning %q (%v elapsed)\n", filename, time.Since(started).Round(time.Second))
+			case <-stop:
+				return
+			}
+		}
+	}()
+	defer func() {
+		heartbeat.Stop()
+		close(stop)
+	}()
+
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	meta := scanner.Meta{Filename: filename, Hash: hash, Size: int64(len(content))}
+
+	results, err := p.policy.Scan(ctx, bytes.NewReader(content), meta)
+	if err != nil {
+		metrics.ObserveScan(metrics.VerdictError, time.Since(started).Seconds(), 0)
+		return fmt.Errorf("could not scan %q: %w", filename, err)
+	}
+
+	verdict, description := scanner.Aggregate(results)
+	metrics.ObserveScan(metricsVerdictLabel(verdict), time.Since(started).Seconds(), len(content))
+
+	switch verdict {
+	case scanner.VerdictFound:
+		log.Printf("proxy: rejected %q: %v", filename, description)
+		return fmt.Errorf("infected file %q: %v", filename, description)
+	case scanner.VerdictError:
+		return fmt.Errorf("scan error for %q: %v", filename, description)
+	case scanner.VerdictPending:
+		return fmt.Errorf("scan inconclusive for %q: %v", filename, description)
+	}
+
+	return nil
+}
+
+// metricsVerdictLabel maps a scanner.Verdict to the metrics.Verdict* label
+// used for ScansTotal.
+func metricsVerdictLabel(v scanner.Verdict) string {
+	switch v {
+	case scanner.VerdictClean:
+		return metrics.VerdictOK
+	case scanner.VerdictFound:
+		return metrics.VerdictFound
+	case scanner.VerdictPending:
+		return metrics.VerdictPending
+	default:
+		return metrics.VerdictError
+	}
+}
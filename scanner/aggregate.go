@@ -0,0 +1,36 @@
+package scanner
+
+import "fmt"
+
+// Aggregate reduces a chain of scanner Results into a single overall
+// Verdict and description. Found outranks Error, which outranks Pending,
+// which outranks Clean, so the worst news any stage reported wins.
+func Aggregate(results []Result) (Verdict, string) {
+	verdict := VerdictClean
+	description := ""
+
+	for _, res := range results {
+		if rank(res.Verdict) > rank(verdict) {
+			verdict = res.Verdict
+			description = fmt.Sprintf("%s: %s", res.Scanner, res.Description)
+		}
+		if res.Verdict == VerdictFound {
+			break
+		}
+	}
+
+	return verdict, description
+}
+
+func rank(v Verdict) int {
+	switch v {
+	case VerdictFound:
+		return 3
+	case VerdictError:
+		return 2
+	case VerdictPending:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,77 @@
+package scanner
+
+import "testing"
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		name        string
+		results     []Result
+		wantVerdict Verdict
+		wantDesc    string
+	}{
+		{
+			name:        "no results",
+			results:     nil,
+			wantVerdict: VerdictClean,
+			wantDesc:    "",
+		},
+		{
+			name: "all clean",
+			results: []Result{
+				{Scanner: "clamd", Verdict: VerdictClean},
+				{Scanner: "virustotal", Verdict: VerdictClean},
+			},
+			wantVerdict: VerdictClean,
+			wantDesc:    "",
+		},
+		{
+			name: "pending outranks clean",
+			results: []Result{
+				{Scanner: "clamd", Verdict: VerdictClean},
+				{Scanner: "virustotal", Verdict: VerdictPending, Description: "submitted for analysis"},
+			},
+			wantVerdict: VerdictPending,
+			wantDesc:    "virustotal: submitted for analysis",
+		},
+		{
+			name: "error outranks pending",
+			results: []Result{
+				{Scanner: "virustotal", Verdict: VerdictPending, Description: "submitted for analysis"},
+				{Scanner: "yara", Verdict: VerdictError, Description: "rules load failed"},
+			},
+			wantVerdict: VerdictError,
+			wantDesc:    "yara: rules load failed",
+		},
+		{
+			name: "found outranks everything and stops aggregation",
+			results: []Result{
+				{Scanner: "clamd", Verdict: VerdictError, Description: "connection refused"},
+				{Scanner: "yara", Verdict: VerdictFound, Description: "Eicar-Test-Signature"},
+				{Scanner: "virustotal", Verdict: VerdictClean},
+			},
+			wantVerdict: VerdictFound,
+			wantDesc:    "yara: Eicar-Test-Signature",
+		},
+		{
+			name: "a later found wins over an earlier clean",
+			results: []Result{
+				{Scanner: "clamd", Verdict: VerdictClean},
+				{Scanner: "virustotal", Verdict: VerdictFound, Description: "malicious"},
+			},
+			wantVerdict: VerdictFound,
+			wantDesc:    "virustotal: malicious",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verdict, desc := Aggregate(tt.results)
+			if verdict != tt.wantVerdict {
+				t.Errorf("Aggregate() verdict = %v, want %v", verdict, tt.wantVerdict)
+			}
+			if desc != tt.wantDesc {
+				t.Errorf("Aggregate() description = %q, want %q", desc, tt.wantDesc)
+			}
+		})
+	}
+}
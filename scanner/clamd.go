@@ -0,0 +1,64 @@
+package scanner
+
+import (
+	"context"
+	"io"
+
+	"github.com/dutchcoders/go-clamd"
+	"github.com/klippa-app/clamav-rest/metrics"
+)
+
+// ClamdScanner scans content against a clamd daemon via INSTREAM.
+type ClamdScanner struct {
+	addr string
+}
+
+// NewClamdScanner returns a Scanner backed by the clamd instance at addr.
+func NewClamdScanner(addr string) *ClamdScanner {
+	return &ClamdScanner{addr: addr}
+}
+
+// Name returns "clamd".
+func (s *ClamdScanner) Name() string { return "clamd" }
+
+// Ping reports whether clamd is reachable, for use by a readiness probe.
+func (s *ClamdScanner) Ping(ctx context.Context) error {
+	return clamd.NewClamd(s.addr).Ping()
+}
+
+// Scan streams r to clamd and translates its verdict into a Result. The
+// scan is aborted as soon as ctx is done, e.g. because the client
+// disconnected.
+func (s *ClamdScanner) Scan(ctx context.Context, r io.Reader, meta Meta) (Result, error) {
+	c := clamd.NewClamd(s.addr)
+
+	abort := make(chan bool, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			select {
+			case abort <- true:
+			default:
+			}
+		case <-stop:
+		}
+	}()
+
+	response, err := c.ScanStream(r, abort)
+	if err != nil {
+		metrics.ClamdConnectionFailures.Inc()
+		return Result{Scanner: s.Name(), Verdict: VerdictError}, err
+	}
+
+	res := <-response
+	switch res.Status {
+	case clamd.RES_OK:
+		return Result{Scanner: s.Name(), Verdict: VerdictClean}, nil
+	case clamd.RES_FOUND:
+		return Result{Scanner: s.Name(), Verdict: VerdictFound, Description: res.Description}, nil
+	default:
+		return Result{Scanner: s.Name(), Verdict: VerdictError, Description: res.Description}, nil
+	}
+}
@@ -0,0 +1,83 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+)
+
+// Stage is one step of a Policy.
+type Stage struct {
+	Scanner Scanner
+
+	// OnlyClean runs this stage only if every prior stage reported
+	// VerdictClean, e.g. to send clean-but-suspicious content to a secondary
+	// backend without re-submitting everything clamd already cleared.
+	OnlyClean bool
+}
+
+// Policy chains Scanners and aggregates their Results. Stages run in order
+// and share the same buffered content, so each Scanner only needs to handle
+// a single io.Reader pass.
+type Policy struct {
+	Stages []Stage
+}
+
+// NewPolicy returns a Policy that runs stages in order.
+func NewPolicy(stages ...Stage) *Policy {
+	return &Policy{Stages: stages}
+}
+
+// Ping checks the health of every stage whose Scanner supports it, e.g. so a
+// readiness probe can depend on the Policy instead of a specific backend.
+// It returns the first error encountered.
+func (p *Policy) Ping(ctx context.Context) error {
+	for _, stage := range p.Stages {
+		pinger, ok := stage.Scanner.(Pinger)
+		if !ok {
+			continue
+		}
+		if err := pinger.Ping(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan buffers r once and runs every applicable stage against it, stopping
+// as soon as a stage reports VerdictFound or ctx is done.
+func (p *Policy) Scan(ctx context.Context, r io.Reader, meta Meta) ([]Result, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Result
+	clean := true
+
+	for _, stage := range p.Stages {
+		if ctx.Err() != nil {
+			results = append(results, Result{Scanner: stage.Scanner.Name(), Verdict: VerdictError, Description: ctx.Err().Error()})
+			break
+		}
+		if stage.OnlyClean && !clean {
+			continue
+		}
+
+		res, err := stage.Scanner.Scan(ctx, bytes.NewReader(content), meta)
+		if err != nil {
+			res = Result{Scanner: stage.Scanner.Name(), Verdict: VerdictError, Description: err.Error()}
+		}
+		results = append(results, res)
+
+		if res.Verdict == VerdictFound {
+			return results, nil
+		}
+		if res.Verdict != VerdictClean {
+			clean = false
+		}
+	}
+
+	return results, nil
+}
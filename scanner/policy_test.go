@@ -0,0 +1,138 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+// fakeScanner returns a fixed Result (or error) and records whether it ran.
+type fakeScanner struct {
+	name   string
+	result Result
+	err    error
+	ran    bool
+}
+
+func (s *fakeScanner) Name() string { return s.name }
+
+func (s *fakeScanner) Scan(ctx context.Context, r io.Reader, meta Meta) (Result, error) {
+	s.ran = true
+	if s.err != nil {
+		return Result{}, s.err
+	}
+	return s.result, nil
+}
+
+func TestPolicyScanRunsStagesInOrder(t *testing.T) {
+	first := &fakeScanner{name: "first", result: Result{Scanner: "first", Verdict: VerdictClean}}
+	second := &fakeScanner{name: "second", result: Result{Scanner: "second", Verdict: VerdictClean}}
+
+	p := NewPolicy(Stage{Scanner: first}, Stage{Scanner: second})
+
+	results, err := p.Scan(context.Background(), bytes.NewReader([]byte("content")), Meta{})
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	if !first.ran || !second.ran {
+		t.Fatalf("expected both stages to run, first.ran=%v second.ran=%v", first.ran, second.ran)
+	}
+	if len(results) != 2 {
+		t.Fatalf("len(results) = %d, want 2", len(results))
+	}
+}
+
+func TestPolicyScanStopsOnFound(t *testing.T) {
+	first := &fakeScanner{name: "first", result: Result{Scanner: "first", Verdict: VerdictFound, Description: "Eicar-Test-Signature"}}
+	second := &fakeScanner{name: "second", result: Result{Scanner: "second", Verdict: VerdictClean}}
+
+	p := NewPolicy(Stage{Scanner: first}, Stage{Scanner: second})
+
+	results, err := p.Scan(context.Background(), bytes.NewReader([]byte("content")), Meta{})
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	if second.ran {
+		t.Fatal("expected a FOUND verdict to stop the chain, but the second stage still ran")
+	}
+	if len(results) != 1 || results[0].Verdict != VerdictFound {
+		t.Fatalf("results = %+v, want a single FOUND result", results)
+	}
+}
+
+func TestPolicyScanOnlyCleanGating(t *testing.T) {
+	dirty := &fakeScanner{name: "dirty", result: Result{Scanner: "dirty", Verdict: VerdictError, Description: "connection refused"}}
+	onlyClean := &fakeScanner{name: "only-clean", result: Result{Scanner: "only-clean", Verdict: VerdictClean}}
+
+	p := NewPolicy(
+		Stage{Scanner: dirty},
+		Stage{Scanner: onlyClean, OnlyClean: true},
+	)
+
+	results, err := p.Scan(context.Background(), bytes.NewReader([]byte("content")), Meta{})
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	if onlyClean.ran {
+		t.Fatal("expected the OnlyClean stage to be skipped after a non-clean verdict, but it ran")
+	}
+	if len(results) != 1 {
+		t.Fatalf("len(results) = %d, want 1", len(results))
+	}
+}
+
+func TestPolicyScanOnlyCleanRunsAfterClean(t *testing.T) {
+	clean := &fakeScanner{name: "clean", result: Result{Scanner: "clean", Verdict: VerdictClean}}
+	onlyClean := &fakeScanner{name: "only-clean", result: Result{Scanner: "only-clean", Verdict: VerdictClean}}
+
+	p := NewPolicy(
+		Stage{Scanner: clean},
+		Stage{Scanner: onlyClean, OnlyClean: true},
+	)
+
+	results, err := p.Scan(context.Background(), bytes.NewReader([]byte("content")), Meta{})
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	if !onlyClean.ran {
+		t.Fatal("expected the OnlyClean stage to run after every prior stage reported clean")
+	}
+	if len(results) != 2 {
+		t.Fatalf("len(results) = %d, want 2", len(results))
+	}
+}
+
+func TestPolicyScanTranslatesScannerError(t *testing.T) {
+	failing := &fakeScanner{name: "failing", err: errors.New("boom")}
+
+	p := NewPolicy(Stage{Scanner: failing})
+
+	results, err := p.Scan(context.Background(), bytes.NewReader([]byte("content")), Meta{})
+	if err != nil {
+		t.Fatalf("Scan() error = %v, want nil (the stage error is reported via the Result, not returned)", err)
+	}
+	if len(results) != 1 || results[0].Verdict != VerdictError {
+		t.Fatalf("results = %+v, want a single ERROR result", results)
+	}
+}
+
+func TestPolicyScanAbortsOnCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	after := &fakeScanner{name: "after", result: Result{Scanner: "after", Verdict: VerdictClean}}
+	p := NewPolicy(Stage{Scanner: after})
+
+	results, err := p.Scan(ctx, bytes.NewReader([]byte("content")), Meta{})
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	if after.ran {
+		t.Fatal("expected a cancelled context to stop the chain before the stage ran")
+	}
+	if len(results) != 1 || results[0].Verdict != VerdictError {
+		t.Fatalf("results = %+v, want a single ERROR result for the cancelled context", results)
+	}
+}
@@ -0,0 +1,53 @@
+// Package scanner abstracts over malware-scanning backends so clamav-rest
+// can compose clamd with optional secondary engines behind a single
+// interface, instead of every call site depending on clamd directly.
+package scanner
+
+import (
+	"context"
+	"io"
+)
+
+// Verdict is the outcome of a single backend's scan.
+type Verdict string
+
+// Possible Verdict values. VerdictClean means the backend found nothing;
+// VerdictFound means it matched a signature; VerdictError means the backend
+// could not complete the scan; VerdictPending means the backend has not
+// analyzed the content yet and cannot vouch for it either way.
+const (
+	VerdictClean   Verdict = "clean"
+	VerdictFound   Verdict = "found"
+	VerdictError   Verdict = "error"
+	VerdictPending Verdict = "pending"
+)
+
+// Meta carries request-scoped information a Scanner may use, such as the
+// original filename or a precomputed hash, without requiring it to re-derive
+// them from the stream.
+type Meta struct {
+	Filename string
+	Hash     string
+	Size     int64
+}
+
+// Result is a backend-agnostic scan outcome.
+type Result struct {
+	Scanner     string  `json:"scanner"`
+	Verdict     Verdict `json:"verdict"`
+	Description string  `json:"description,omitempty"`
+}
+
+// Scanner scans the content read from r and reports a Result. Backends must
+// fully consume r, and must abort as soon as possible once ctx is done, e.g.
+// because the client disconnected.
+type Scanner interface {
+	Name() string
+	Scan(ctx context.Context, r io.Reader, meta Meta) (Result, error)
+}
+
+// Pinger is implemented by Scanners that support a lightweight health
+// check, e.g. for use by a readiness probe.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
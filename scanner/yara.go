@@ -0,0 +1,73 @@
+//go:build yara
+
+// The YARA backend requires the cgo bindings in
+// github.com/hillu/go-yara/v4 and the system libyara, so it is only
+// compiled in when building with -tags yara.
+package scanner
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/hillu/go-yara/v4"
+)
+
+// YaraScanner matches scanned content against a compiled YARA rule set.
+type YaraScanner struct {
+	rules *yara.Rules
+}
+
+// NewYaraScanner compiles the YARA rules file at rulesPath and returns a
+// Scanner backed by them.
+func NewYaraScanner(rulesPath string) (*YaraScanner, error) {
+	compiler, err := yara.NewCompiler()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(rulesPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := compiler.AddFile(file, ""); err != nil {
+		return nil, err
+	}
+
+	rules, err := compiler.GetRules()
+	if err != nil {
+		return nil, err
+	}
+
+	return &YaraScanner{rules: rules}, nil
+}
+
+// Name returns "yara".
+func (s *YaraScanner) Name() string { return "yara" }
+
+// Scan matches content against the compiled rule set. YARA matching is
+// local and fast enough that ctx is not consulted mid-scan.
+func (s *YaraScanner) Scan(ctx context.Context, r io.Reader, meta Meta) (Result, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return Result{Scanner: s.Name(), Verdict: VerdictError}, err
+	}
+
+	var matches yara.MatchRules
+	if err := s.rules.ScanMem(content, 0, 0, &matches); err != nil {
+		return Result{Scanner: s.Name(), Verdict: VerdictError}, err
+	}
+
+	if len(matches) == 0 {
+		return Result{Scanner: s.Name(), Verdict: VerdictClean}, nil
+	}
+
+	return Result{
+		Scanner:     s.Name(),
+		Verdict:     VerdictFound,
+		Description: matches[0].Rule,
+	}, nil
+}
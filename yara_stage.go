@@ -0,0 +1,23 @@
+//go:build yara
+
+package main
+
+import (
+	"github.com/klippa-app/clamav-rest/config"
+	"github.com/klippa-app/clamav-rest/scanner"
+)
+
+// newYaraStage compiles cfg.YaraRulesPath into a Stage if configured. Built
+// only with -tags yara, alongside the YARA cgo bindings it depends on.
+func newYaraStage(cfg *config.Config) (*scanner.Stage, error) {
+	if cfg.YaraRulesPath == "" {
+		return nil, nil
+	}
+
+	s, err := scanner.NewYaraScanner(cfg.YaraRulesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &scanner.Stage{Scanner: s}, nil
+}
@@ -0,0 +1,20 @@
+//go:build !yara
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/klippa-app/clamav-rest/config"
+	"github.com/klippa-app/clamav-rest/scanner"
+)
+
+// newYaraStage reports an error if YaraRulesPath is configured, since this
+// binary was not built with -tags yara and has no YARA support compiled in.
+func newYaraStage(cfg *config.Config) (*scanner.Stage, error) {
+	if cfg.YaraRulesPath == "" {
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("yara_rules_path is set but this binary was not built with -tags yara")
+}